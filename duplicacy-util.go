@@ -16,18 +16,17 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"errors"
 	"io"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/theckman/go-flock"
 )
 
 var (
@@ -36,14 +35,32 @@ var (
 	cmdGlobalConfig string
 
 	// Binary options for what operations to perform
-	cmdAll    bool
-	cmdBackup bool
-	cmdCheck  bool
-	cmdPrune  bool
+	cmdAll     bool
+	cmdBackup  bool
+	cmdCheck   bool
+	cmdPrune   bool
+	cmdRestore bool
+
+	// Sub-flags for -restore
+	cmdRestoreRevision int
+	cmdRestoreTime     string
+	cmdRestoreStorage  string
+	cmdRestoreDest     string
+	cmdRestorePaths    string
 
 	sendMail	bool
 	testMail    bool
 
+	// Print what would be executed instead of running duplicacy/hooks
+	cmdDryRun bool
+
+	// Overrides the lockTimeout value from the global config, if non-zero
+	cmdLockTimeout time.Duration
+
+	// Logging format/level ("text"/"json" and "debug"/"info"/"warn"/"error")
+	logFormatFlag string
+	logLevelFlag  string
+
 	debugFlag   bool
 	quietFlag   bool
 	verboseFlag bool
@@ -56,6 +73,14 @@ var (
 	// Mail message body to send upon completion
 	mailBody []string
 
+	// Package-level logger used whenever no per-config logger is available
+	// (argument parsing, global config errors, etc). Initialized here rather
+	// than left nil until main() runs, so any code that logs through a nil
+	// logger (e.g. acquireLock, or a test calling it directly) never derefs a
+	// nil appLogger; main() reassigns it once flags are parsed so verbosity
+	// still reflects -d/-q/-log-level.
+	appLogger *slog.Logger = newAppLogger()
+
 	// Create configuration object to load configuration file
 	configFile *ConfigFile = NewConfigFile()
 )
@@ -69,46 +94,41 @@ func init() {
 	flag.BoolVar(&cmdCheck, "c", false, "Perform duplicacy check operation")
 	flag.StringVar(&cmdGlobalConfig, "g", "", "Global configuration file name")
 	flag.BoolVar(&cmdPrune, "p", false, "Perform duplicacy prune operation")
+	flag.BoolVar(&cmdRestore, "r", false, "Perform duplicacy restore operation (mutually exclusive with -a)")
+	flag.BoolVar(&cmdRestore, "restore", false, "Long form of -r")
+
+	flag.IntVar(&cmdRestoreRevision, "revision", 0, "Revision number to restore (ignored when -time is given)")
+	flag.StringVar(&cmdRestoreTime, "time", "", "Restore the newest revision at or before this time, format \"2006-01-02 15:04\"")
+	flag.StringVar(&cmdRestoreStorage, "storage", "", "Storage to restore from (defaults to the config's first backup storage)")
+	flag.StringVar(&cmdRestoreDest, "dest", "", "Destination directory for the restore (defaults to the config's repository directory)")
+	flag.StringVar(&cmdRestorePaths, "paths", "", "Comma-separated list of globs to restore (defaults to everything)")
 
 	flag.BoolVar(&sendMail, "m", false, "Send E-Mail with results of operations (implies quiet)")
 	flag.BoolVar(&testMail, "tm", false, "Send a test message via E-Mail")
 
-	flag.BoolVar(&debugFlag, "d", false, "Enable debug output (implies verbose)")
-	flag.BoolVar(&quietFlag, "q", false, "Quiet operations (generate output only in case of error)")
-	flag.BoolVar(&verboseFlag, "v", false, "Enable verbose output")
-	flag.BoolVar(&versionFlag, "version", false, "Display version number")
-}
+	flag.BoolVar(&cmdDryRun, "n", false, "Show what would be done without executing duplicacy or hooks")
+	flag.BoolVar(&cmdDryRun, "dry-run", false, "Long form of -n")
 
-// Generic output routine to generate output to screen (and E-Mail) - Allow output writer
-func logFMessage(w io.Writer, logger *log.Logger, message string) {
-	if logger != nil {
-		logger.Println(message)
-	}
+	flag.IntVar(&cmdMaxParallel, "j", 0, "Maximum number of storages to operate on in parallel within a phase (overrides global config)")
 
-	text := fmt.Sprint(time.Now().Format("15:04:05"), " ", message)
-	mailBody = append(mailBody, text)
-	if w == os.Stdout {
-		fmt.Fprintln(w, text)
-	} else {
-		// Fatal message shouldn't have time prefix
-		fmt.Fprintln(w, message)
-	}
-}
+	flag.DurationVar(&cmdLockTimeout, "lock-timeout", 0, "Maximum time to wait for the exclusive lock (overrides global config)")
 
-// Generic error output routine to generate output to screen (and E-Mail)
-func logError(logger *log.Logger, message string) {
-	logFMessage(os.Stderr, logger, message)
-}
+	flag.StringVar(&logFormatFlag, "log-format", "text", "Log output format (text|json)")
+	flag.StringVar(&logLevelFlag, "log-level", "", "Log level (debug|info|warn|error), overrides -d/-q")
 
-// Generic output routine to generate output to screen (and E-Mail)
-func logMessage(logger *log.Logger, message string) {
-	logFMessage(os.Stdout, logger, message)
+	flag.BoolVar(&debugFlag, "d", false, "Enable debug output (implies verbose)")
+	flag.BoolVar(&quietFlag, "q", false, "Quiet operations (generate output only in case of error)")
+	flag.BoolVar(&verboseFlag, "v", false, "Enable verbose output")
+	flag.BoolVar(&versionFlag, "version", false, "Display version number")
 }
 
 func main() {
 	// Parse the command line arguments and validate results
 	flag.Parse()
 
+	if debugFlag { verboseFlag = true }
+	appLogger = newAppLogger()
+
 	if flag.NArg() != 0 {
 		logError(nil, fmt.Sprint("Error: Unrecognized arguments specified on command line: ", flag.Args()))
 		os.Exit(2)
@@ -121,7 +141,11 @@ func main() {
 	}
 
 	if cmdAll { cmdBackup, cmdPrune, cmdCheck = true, true, true }
-	if debugFlag { verboseFlag = true }
+
+	if cmdRestore && (cmdAll || cmdBackup || cmdPrune || cmdCheck) {
+		logError(nil, "Error: -r/-restore cannot be combined with -a, -b, -p, or -c")
+		os.Exit(2)
+	}
 
 	logMessage(nil, fmt.Sprintf("duplicacy-util running, version: %s, Git Hash: %s", versiontext, githash))
 
@@ -132,14 +156,25 @@ func main() {
 
 	// Handle request to send E-Mail, if requested
 	if testMail {
-		if err := sendTestMessage("duplicacy-util: Backup results for configuration test (success)",
-				[]string{"This is a test E-Mail message for a successful backup job"}); err != nil {
-			fmt.Fprintln(os.Stderr, "Error sending succcess E-Mail message:", err)
+		notifiers, err := buildNotifiers(globalNotifications)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error configuring notifications:", err)
+			os.Exit(1)
 		}
 
-		if err := sendTestMessage("duplicacy-util: Backup results for configuration test (FAILURE)",
-			[]string{"This is a test E-Mail message for a failed backup job"}); err != nil {
-			fmt.Fprintln(os.Stderr, "Error sending failed E-Mail message:", err)
+		success := BackupResult{Config: cmdConfig, Success: true,
+			Operations: []OperationResult{{Op: "test", Storage: "test", Duration: 0, Stdout: "test notification", Stderr: "test notification"}},
+			MailBody:   []string{"test notification"}}
+		failure := BackupResult{Config: cmdConfig, Success: false, Error: errors.New("synthetic test failure"),
+			MailBody: []string{"synthetic test failure"}}
+
+		for _, notifier := range notifiers {
+			if err := notifier.Notify(context.Background(), success); err != nil {
+				fmt.Fprintln(os.Stderr, "Error sending success test notification:", err)
+			}
+			if err := notifier.Notify(context.Background(), failure); err != nil {
+				fmt.Fprintln(os.Stderr, "Error sending failure test notification:", err)
+			}
 		}
 		os.Exit(1)
 	}
@@ -157,8 +192,8 @@ func main() {
 	}
 
 	// Everything is loaded; make sure we hae something to do
-	if !cmdBackup && !cmdPrune && !cmdCheck {
-		logError(nil, "Error: No operations to perform (specify -b, -p, -c, or -a)")
+	if !cmdBackup && !cmdPrune && !cmdCheck && !cmdRestore {
+		logError(nil, "Error: No operations to perform (specify -b, -p, -c, -r, or -a)")
 		os.Exit(1)
 	}
 
@@ -170,42 +205,64 @@ func main() {
 }
 
 func obtainLock() int {
-	// Obtain a lock to make sure we don't overlap operations against a configuration
-	lockfile := filepath.Join(globalLockDir, cmdConfig + ".lock")
-	fileLock := flock.NewFlock(lockfile)
+	// Obtain a lock to make sure we don't overlap operations against a configuration.
+	// Restores use a distinct lock file so they can run while a scheduled backup is
+	// locked out (and vice versa).
+	lockSuffix := ".lock"
+	if cmdRestore {
+		lockSuffix = ".restore.lock"
+	}
+	lockfile := filepath.Join(globalLockDir, cmdConfig + lockSuffix)
 
-	locked, err := fileLock.TryLock()
-	if err != nil {
-		logError(nil, fmt.Sprint("Error: ", err))
-		return 201
+	timeout := globalLockTimeout
+	if cmdLockTimeout > 0 {
+		timeout = cmdLockTimeout
 	}
 
-	if ! locked {
-		// do not have exclusive lock
-		err = errors.New("unable to obtain lock using lockfile: " + lockfile)
+	release, err := acquireLock(lockfile, timeout, globalLockRetryInterval)
+	if err != nil {
 		logError(nil, fmt.Sprint("Error: ", err))
+		dispatchNotifications(BackupResult{Config: cmdConfig, Success: false, Error: err})
+		if os.IsPermission(err) {
+			return 201
+		}
 		return 200
 	}
+	defer release()
 
-	// flock doesn't remove the lock file when done, so let's do it ourselves
-	// (ignore any errors if we can't remove the lock file)
-	defer os.Remove(lockfile)
-	defer fileLock.Unlock()
+	// Perform operations (backup/restore/whatever)
+	startTime := time.Now()
+	if cmdRestore {
+		err = performRestore()
+	} else {
+		err = performBackup()
+	}
+
+	dispatchNotifications(BackupResult{
+		Config:     cmdConfig,
+		Success:    err == nil,
+		Elapsed:    time.Since(startTime),
+		Operations: lastOperations,
+		MailBody:   mailBody,
+		Error:      err,
+	})
 
-	// Perform operations (backup or whatever)
-	if err := performBackup(); err != nil {
+	if err != nil {
 		return 500
 	}
 
 	return 0
 }
 
-func performBackup() error {
+func performBackup() (err error) {
 	// Handle log file rotation (before any output to log file so old one doesn't get trashed)
+	// Skipped in dry-run mode so operators can iterate on a config repeatedly.
 
-	fmt.Println(time.Now().Format("15:04:05"), "Rotating log files")
-	if err := rotateLogFiles(); err != nil {
-		return err
+	if !cmdDryRun {
+		fmt.Println(time.Now().Format("15:04:05"), "Rotating log files")
+		if err := rotateLogFiles(); err != nil {
+			return err
+		}
 	}
 
 	// Create output log file
@@ -214,87 +271,99 @@ func performBackup() error {
 		logError(nil, fmt.Sprint("Error: ", err))
 		return err
 	}
-	logger := log.New(file, "", log.Ltime)
+	logger := newOperationLogger(file)
+	lastOperations = nil
+	mailBody = nil
+
+	// Regardless of which phase fails, run any user-defined onFailure hooks
+	// before returning so databases can be un-quiesced, alerts sent, etc.
+	defer func() {
+		if err != nil {
+			if hookErr := runHooks("onFailure", configFile.onFailure, logger); hookErr != nil {
+				logError(logger, fmt.Sprint("Error: onFailure hook failed: ", hookErr))
+			}
+		}
+	}()
 
 	startTime := time.Now()
 
 	logMessage(logger, fmt.Sprint("Beginning backup on ", time.Now().Format("01-02-2006 15:04:05")))
 
-
-	anon := func(s string) { logger.Println(s) }
-
-	// Perform backup/copy operations if requested
+	// Perform backup/copy operations if requested. Each phase's storages run
+	// through runPhase, which fans them out across maxParallelism() workers
+	// while still finishing the whole phase before the next one starts.
 	if cmdBackup {
-		for i := range configFile.backupInfo {
-			logger.Println("######################################################################")
-			cmdArgs := []string{"backup", "-storage", configFile.backupInfo[i]["name"], "-threads", configFile.backupInfo[i]["threads"], "-stats"}
-			logMessage(logger, fmt.Sprint("Backing up to storage ", configFile.backupInfo[i]["name"],
-				" with ", configFile.backupInfo[i]["threads"], " threads"))
-			if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
-			err = Executor(duplicacyPath, cmdArgs, configFile.repoDir, anon)
-			if err != nil {
-				logError(logger, fmt.Sprint( "Error executing command: ", err))
-				return err
-			}
+		if err = runHooks("preBackup", configFile.preBackup, logger); err != nil {
+			return err
+		}
+
+		if err = runPhase(configFile.backupInfo, logger, runBackupItem); err != nil {
+			return err
 		}
 		if len(configFile.copyInfo) != 0 {
-			for i := range configFile.copyInfo {
-				logger.Println("######################################################################")
-				cmdArgs := []string{"copy", "-threads", configFile.copyInfo[i]["threads"],
-					"-from", configFile.copyInfo[i]["from"], "-to", configFile.copyInfo[i]["to"]}
-				logMessage(logger, fmt.Sprint("Copying from storage ", configFile.copyInfo[i]["from"],
-					" to storage ", configFile.copyInfo[i]["to"], " with ", configFile.copyInfo[i]["threads"], " threads"))
-				if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
-				err = Executor(duplicacyPath, cmdArgs, configFile.repoDir, anon)
-				if err != nil {
-					logError(logger, fmt.Sprint("Error executing command: ", err))
-					return err
-				}
+			if err = runPhase(configFile.copyInfo, logger, runCopyItem); err != nil {
+				return err
 			}
 		}
+
+		if err = runHooks("postBackup", configFile.postBackup, logger); err != nil {
+			return err
+		}
 	}
 
 	// Perform prune operations if requested
 	if cmdPrune {
-		for i := range configFile.pruneInfo {
-			logger.Println("######################################################################")
-			cmdArgs := []string{"prune", "-all", "-storage", configFile.pruneInfo[i]["storage"]}
-			cmdArgs = append(cmdArgs, strings.Split(configFile.pruneInfo[i]["keep"], " ")...)
-			logMessage(logger, fmt.Sprint("Pruning storage ", configFile.pruneInfo[i]["storage"]))
-			if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
-			err = Executor(duplicacyPath, cmdArgs, configFile.repoDir, anon)
-			if err != nil {
-				logError(logger, fmt.Sprint("Error executing command: ", err))
-				return err
-			}
+		if err = runHooks("prePrune", configFile.prePrune, logger); err != nil {
+			return err
+		}
+
+		if err = runPhase(configFile.pruneInfo, logger, runPruneItem); err != nil {
+			return err
+		}
+
+		if err = runHooks("postPrune", configFile.postPrune, logger); err != nil {
+			return err
 		}
 	}
 
 	// Perform check operations if requested
 	if cmdCheck {
-		for i := range configFile.checkInfo {
-			logger.Println("######################################################################")
-			cmdArgs := []string{"check", "-storage", configFile.checkInfo[i]["storage"]}
-			if configFile.checkInfo[i]["all"] == "true" { cmdArgs = append(cmdArgs, "-all") }
-			logMessage(logger, fmt.Sprint("Checking storage ", configFile.pruneInfo[i]["storage"]))
-			if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
-			err = Executor(duplicacyPath, cmdArgs, configFile.repoDir, anon)
-			if err != nil {
-				logError(logger, fmt.Sprint("Error executing command: ", err))
-				return err
-			}
+		if err = runHooks("preCheck", configFile.preCheck, logger); err != nil {
+			return err
+		}
+
+		if err = runPhase(configFile.checkInfo, logger, runCheckItem); err != nil {
+			return err
+		}
+
+		if err = runHooks("postCheck", configFile.postCheck, logger); err != nil {
+			return err
 		}
 	}
 
 	endTime := time.Now()
 	elapsedTime := endTime.Sub(startTime)
 
-	logger.Println("######################################################################")
+	logger.Debug("######################################################################")
 	logMessage(logger, fmt.Sprint("Operations completed in ", elapsedTime))
+	for _, op := range lastOperations {
+		logMessage(logger, fmt.Sprint("  ", op.Op, " ", op.Storage, ": ", op.Duration))
+	}
 
 	return nil
 }
 
+// runDuplicacy invokes duplicacyPath with cmdArgs through Executor, unless
+// cmdDryRun is set, in which case it only logs the argv/working directory
+// that would have been run and returns nil without spawning anything.
+func runDuplicacy(logger *slog.Logger, duplicacyPath string, cmdArgs []string, workDir string, output func(string)) error {
+	if cmdDryRun {
+		logMessage(logger, "would run", "command", duplicacyPath, "args", strings.Join(cmdArgs, " "), "dir", workDir)
+		return nil
+	}
+	return Executor(duplicacyPath, cmdArgs, workDir, output)
+}
+
 func rotateLogFiles() error {
 	logFileRoot := filepath.Join(globalLogDir, cmdConfig) + ".log"
 
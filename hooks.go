@@ -0,0 +1,114 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HookCommand describes a single user-defined command to run around a backup,
+// copy, prune, or check phase (or upon failure of any of them). Command is a
+// shell command or executable path followed by its arguments, WorkDir is the
+// directory to run it in (defaults to configFile.repoDir when empty), and
+// Timeout, when non-zero, causes the hook to be treated as failed if it runs
+// too long.
+type HookCommand struct {
+	Command []string
+	WorkDir string
+	Timeout time.Duration
+}
+
+// runHooks executes each hook in order, logging its invocation and output
+// through logger/mailBody the same way duplicacy invocations are. label
+// identifies the phase (e.g. "preBackup", "onFailure") for log messages. The
+// first hook to fail aborts the remaining hooks in the list and its error is
+// returned to the caller.
+func runHooks(label string, hooks []HookCommand, logger *slog.Logger) error {
+	anon := func(s string) { logger.Debug(s) }
+
+	for _, hook := range hooks {
+		if len(hook.Command) == 0 {
+			continue
+		}
+
+		workDir := hook.WorkDir
+		if workDir == "" {
+			workDir = configFile.repoDir
+		}
+
+		if cmdDryRun {
+			logMessage(logger, "would run hook", "phase", label, "command", strings.Join(hook.Command, " "))
+			continue
+		}
+
+		logMessage(logger, "running hook", "phase", label, "command", strings.Join(hook.Command, " "))
+
+		err := runHookCommand(hook, workDir, anon)
+		if err != nil {
+			logError(logger, "hook failed", "phase", label, "command", strings.Join(hook.Command, " "), "error", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runHookCommand invokes a single hook, enforcing hook.Timeout when one was
+// specified. Without a timeout it's handed to Executor like any other
+// command. With one, Executor can't be used: it gives no way to kill the
+// process it started, so a timeout would only stop us from waiting on it,
+// leaving the process (and the goroutine still calling output) running
+// unsupervised. Instead we run it ourselves via exec.CommandContext, so the
+// context deadline actually terminates the process.
+func runHookCommand(hook HookCommand, workDir string, output func(string)) error {
+	if hook.Timeout <= 0 {
+		return Executor(hook.Command[0], hook.Command[1:], workDir, output)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Dir = workDir
+
+	pipeR, pipeW := io.Pipe()
+	cmd.Stdout = pipeW
+	cmd.Stderr = pipeW
+
+	scanDone := make(chan struct{})
+	go func() {
+		defer close(scanDone)
+		scanner := bufio.NewScanner(pipeR)
+		for scanner.Scan() {
+			output(scanner.Text())
+		}
+	}()
+
+	runErr := cmd.Run()
+	pipeW.Close()
+	<-scanDone
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook %q timed out after %s", strings.Join(hook.Command, " "), hook.Timeout)
+	}
+	return runErr
+}
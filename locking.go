@@ -0,0 +1,66 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/theckman/go-flock"
+)
+
+// acquireLock obtains an exclusive lock on path, retrying on contention until
+// timeout elapses (a timeout of zero means try exactly once, preserving the
+// old fail-fast behavior). interval controls the delay between retries. On
+// success it returns a release func that unlocks and removes the lock file;
+// the caller should defer it. The returned error distinguishes permission
+// problems (reported via os.IsPermission) from plain lock contention so
+// callers can choose a distinct exit code.
+func acquireLock(path string, timeout, interval time.Duration) (func() error, error) {
+	fileLock := flock.NewFlock(path)
+
+	deadline := time.Now().Add(timeout)
+	loggedRetry := false
+
+	for {
+		locked, err := fileLock.TryLock()
+		if err != nil {
+			return nil, err
+		}
+
+		if locked {
+			release := func() error {
+				// flock doesn't remove the lock file when done, so let's do it
+				// ourselves (ignore any errors if we can't remove the lock file)
+				os.Remove(path)
+				return fileLock.Unlock()
+			}
+			return release, nil
+		}
+
+		if timeout <= 0 || time.Now().After(deadline) {
+			return nil, errors.New("unable to obtain lock using lockfile: " + path)
+		}
+
+		if !loggedRetry {
+			logMessage(nil, fmt.Sprint("Warning: exclusive lock unavailable on first attempt, will retry until ", timeout))
+			loggedRetry = true
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/theckman/go-flock"
+)
+
+func TestAcquireLockRetriesUntilReleased(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	holder := flock.NewFlock(path)
+	locked, err := holder.TryLock()
+	if err != nil || !locked {
+		t.Fatalf("failed to seed contention: locked=%v err=%v", locked, err)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		holder.Unlock()
+		close(released)
+	}()
+
+	release, err := acquireLock(path, 500*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("acquireLock did not retry past contention: %v", err)
+	}
+	<-released
+
+	if err := release(); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+}
+
+func TestAcquireLockTimesOut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	holder := flock.NewFlock(path)
+	locked, err := holder.TryLock()
+	if err != nil || !locked {
+		t.Fatalf("failed to seed contention: locked=%v err=%v", locked, err)
+	}
+	defer holder.Unlock()
+
+	if _, err := acquireLock(path, 50*time.Millisecond, 10*time.Millisecond); err == nil {
+		t.Fatal("expected acquireLock to time out, got nil error")
+	}
+}
+
+func TestAcquireLockNoWaitFailsFast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	holder := flock.NewFlock(path)
+	locked, err := holder.TryLock()
+	if err != nil || !locked {
+		t.Fatalf("failed to seed contention: locked=%v err=%v", locked, err)
+	}
+	defer holder.Unlock()
+
+	if _, err := acquireLock(path, 0, 10*time.Millisecond); err == nil {
+		t.Fatal("expected acquireLock with a zero timeout to fail immediately on contention")
+	}
+}
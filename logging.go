@@ -0,0 +1,224 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// logMessage and logError are thin convenience wrappers kept for the many
+// call sites that predate slog: pass the per-operation logger where one is
+// available (nil falls back to the package-level appLogger), a message, and
+// optional structured attributes (e.g. "storage", name).
+func logMessage(logger *slog.Logger, message string, args ...any) {
+	if logger == nil {
+		logger = appLogger
+	}
+	logger.Info(message, args...)
+}
+
+func logError(logger *slog.Logger, message string, args ...any) {
+	if logger == nil {
+		logger = appLogger
+	}
+	logger.Error(message, args...)
+}
+
+// resolveConsoleLevel maps the legacy -d/-q flags and the new -log-level
+// flag onto a slog.Level for console output. -log-level takes precedence
+// when explicitly recognized; otherwise debug implies everything and quiet
+// implies errors only, preserving prior behavior. -v does not change the
+// console level.
+func resolveConsoleLevel() slog.Level {
+	switch logLevelFlag {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	case "info":
+		return slog.LevelInfo
+	}
+
+	if debugFlag {
+		return slog.LevelDebug
+	}
+	if quietFlag {
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// newAppLogger builds the package-level logger used before any per-config
+// log file exists (argument parsing, global config errors, etc).
+func newAppLogger() *slog.Logger {
+	return slog.New(multiHandler{
+		timeStripHandler{consoleHandler{level: resolveConsoleLevel()}},
+		mailHandler{},
+	})
+}
+
+// newOperationLogger builds the logger used for the duration of a single
+// performBackup run: every record is mirrored to the console (time-stripped
+// for errors), to mailBody for the notification E-Mail, and to the
+// per-config log file using whichever format -log-format selected.
+func newOperationLogger(file *os.File) *slog.Logger {
+	return slog.New(multiHandler{
+		timeStripHandler{consoleHandler{level: resolveConsoleLevel()}},
+		mailHandler{},
+		fileHandler(file),
+	})
+}
+
+// fileHandler returns the slog.Handler that writes every record (regardless
+// of console verbosity) to the per-config log file, as JSON or text per
+// -log-format, so downstream log collectors can parse it directly.
+func fileHandler(file *os.File) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if logFormatFlag == "json" {
+		return slog.NewJSONHandler(file, opts)
+	}
+	return slog.NewTextHandler(file, opts)
+}
+
+// multiHandler fans every record out to each of its handlers.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	for _, h := range m {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := make(multiHandler, len(m))
+	for i, h := range m {
+		next[i] = h.WithAttrs(attrs)
+	}
+	return next
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	next := make(multiHandler, len(m))
+	for i, h := range m {
+		next[i] = h.WithGroup(name)
+	}
+	return next
+}
+
+// timeStripHandler clears a record's timestamp before handing it to the
+// wrapped handler for Error-and-above records, preserving the old behavior
+// where a fatal message printed to the console had no time prefix.
+type timeStripHandler struct {
+	handler slog.Handler
+}
+
+func (t timeStripHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return t.handler.Enabled(ctx, level)
+}
+
+func (t timeStripHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		r.Time = time.Time{}
+	}
+	return t.handler.Handle(ctx, r)
+}
+
+func (t timeStripHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return timeStripHandler{t.handler.WithAttrs(attrs)}
+}
+
+func (t timeStripHandler) WithGroup(name string) slog.Handler {
+	return timeStripHandler{t.handler.WithGroup(name)}
+}
+
+// consoleHandler renders a record as "HH:MM:SS message key=value ..." to
+// stdout (below Error) or stderr (Error and above), matching the format
+// the old logFMessage helper produced by hand.
+type consoleHandler struct {
+	level slog.Level
+}
+
+func (c consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= c.level
+}
+
+func (c consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	line := formatRecord(r)
+	if !r.Time.IsZero() {
+		line = r.Time.Format("15:04:05") + " " + line
+	}
+
+	w := os.Stdout
+	if r.Level >= slog.LevelError {
+		w = os.Stderr
+	}
+	fmt.Fprintln(w, line)
+	return nil
+}
+
+func (c consoleHandler) WithAttrs(_ []slog.Attr) slog.Handler { return c }
+func (c consoleHandler) WithGroup(_ string) slog.Handler      { return c }
+
+// mailHandler appends Info-and-above records to mailBody, always
+// time-prefixed, for inclusion in the completion E-Mail. Debug is excluded
+// so the raw per-line duplicacy/hook output captured via logger.Debug (see
+// ops.go, hooks.go, restore.go) never lands in mailBody: that output is
+// already captured separately and tail-capped per-operation (notify.go's
+// operationTailLines) for notifications, and mailBody carrying the full,
+// uncapped duplicacy output as well would both duplicate it and defeat the
+// capping.
+type mailHandler struct{}
+
+func (mailHandler) Enabled(_ context.Context, level slog.Level) bool { return level >= slog.LevelInfo }
+
+func (mailHandler) Handle(_ context.Context, r slog.Record) error {
+	mailBody = append(mailBody, r.Time.Format("15:04:05")+" "+formatRecord(r))
+	return nil
+}
+
+func (mailHandler) WithAttrs(_ []slog.Attr) slog.Handler { return mailHandler{} }
+func (mailHandler) WithGroup(_ string) slog.Handler      { return mailHandler{} }
+
+// formatRecord renders a record's message followed by its structured
+// attributes as "key=value" pairs, e.g. "backing up storage=foo threads=4".
+func formatRecord(r slog.Record) string {
+	msg := r.Message
+	r.Attrs(func(a slog.Attr) bool {
+		msg += fmt.Sprintf(" %s=%v", a.Key, a.Value.Any())
+		return true
+	})
+	return msg
+}
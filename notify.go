@@ -0,0 +1,252 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// operationTailLines caps how much of an operation's captured output is
+// carried into its Stdout/Stderr tail, so a noisy duplicacy run doesn't blow
+// up the notification payload.
+const operationTailLines = 20
+
+// OperationResult records one backup/copy/prune/check/restore invocation so
+// it can be rendered into a notification. Executor hands back stdout and
+// stderr interleaved through a single callback, so Stdout and Stderr both
+// hold the same tail of captured output; they're kept as separate fields so
+// templates can refer to either name per the request.
+type OperationResult struct {
+	Op       string
+	Storage  string
+	Duration time.Duration
+	Stdout   string
+	Stderr   string
+}
+
+// tailLines joins the last n lines of output (or all of them, if fewer).
+func tailLines(lines []string, n int) string {
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// BackupResult is handed to every configured Notifier once performBackup
+// returns. It's also what -tm synthesizes to exercise each notifier without
+// running a real backup. MailBody mirrors the same human-readable lines the
+// run's mailHandler collected, so a notifier's body template can fall back
+// to "the whole log" instead of only the structured Operations.
+type BackupResult struct {
+	Config     string
+	Success    bool
+	Elapsed    time.Duration
+	Operations []OperationResult
+	MailBody   []string
+	Error      error
+}
+
+// Notifier delivers a BackupResult to one destination (E-Mail, a generic
+// webhook, Slack/Discord, ...).
+type Notifier interface {
+	Notify(ctx context.Context, result BackupResult) error
+}
+
+// lastOperations accumulates the operations performBackup actually ran, so
+// obtainLock can hand a full BackupResult to dispatchNotifications once
+// performBackup returns. Reset at the start of each run, same pattern as the
+// existing mailBody accumulator.
+var lastOperations []OperationResult
+
+// dispatchNotifications builds the notifiers described by the global
+// config's "notifications" section and calls each whose "on" filter matches
+// result.Success, logging (but not failing the run over) any delivery error.
+func dispatchNotifications(result BackupResult) {
+	notifiers, err := buildNotifiers(globalNotifications)
+	if err != nil {
+		logError(nil, fmt.Sprint("Error: failed to configure notifications: ", err))
+		return
+	}
+
+	for i, notifier := range notifiers {
+		if !notificationApplies(globalNotifications[i], result) {
+			continue
+		}
+		if err := notifier.Notify(context.Background(), result); err != nil {
+			logError(nil, fmt.Sprint("Error: notification delivery failed: ", err))
+		}
+	}
+}
+
+func notificationApplies(cfg NotificationConfig, result BackupResult) bool {
+	if len(cfg.On) == 0 {
+		return true
+	}
+	want := "success"
+	if !result.Success {
+		want = "failure"
+	}
+	for _, on := range cfg.On {
+		if on == want {
+			return true
+		}
+	}
+	return false
+}
+
+// buildNotifiers turns the parsed "notifications" config entries into
+// concrete Notifier implementations, dispatching on the destination URL's
+// scheme (smtp://, slack://, discord://, generic+<scheme>://...).
+func buildNotifiers(configs []NotificationConfig) ([]Notifier, error) {
+	notifiers := make([]Notifier, 0, len(configs))
+
+	for _, cfg := range configs {
+		subjectTmpl, err := template.New("subject").Parse(cfg.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("parsing subject template for %q: %w", cfg.URL, err)
+		}
+		bodyTmpl, err := template.New("body").Parse(cfg.Body)
+		if err != nil {
+			return nil, fmt.Errorf("parsing body template for %q: %w", cfg.URL, err)
+		}
+
+		switch {
+		case strings.HasPrefix(cfg.URL, "smtp://"):
+			notifiers = append(notifiers, &smtpNotifier{subject: subjectTmpl, body: bodyTmpl})
+		case strings.HasPrefix(cfg.URL, "slack://"):
+			notifiers = append(notifiers, &webhookNotifier{
+				url:     slackWebhookURL(cfg.URL),
+				subject: subjectTmpl,
+				body:    bodyTmpl,
+				payload: slackPayload,
+			})
+		case strings.HasPrefix(cfg.URL, "discord://"):
+			notifiers = append(notifiers, &webhookNotifier{
+				url:     slackWebhookURL(cfg.URL),
+				subject: subjectTmpl,
+				body:    bodyTmpl,
+				payload: discordPayload,
+			})
+		case strings.HasPrefix(cfg.URL, "generic+"):
+			notifiers = append(notifiers, &webhookNotifier{
+				url:     strings.TrimPrefix(cfg.URL, "generic+"),
+				subject: subjectTmpl,
+				body:    bodyTmpl,
+				payload: genericPayload,
+			})
+		default:
+			return nil, fmt.Errorf("unsupported notification URL: %q", cfg.URL)
+		}
+	}
+
+	return notifiers, nil
+}
+
+func render(tmpl *template.Template, result BackupResult) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, result); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// smtpNotifier preserves the pre-existing E-Mail behavior, now reached
+// through the Notifier interface instead of being called directly.
+type smtpNotifier struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func (n *smtpNotifier) Notify(_ context.Context, result BackupResult) error {
+	subject, err := render(n.subject, result)
+	if err != nil {
+		return err
+	}
+	body, err := render(n.body, result)
+	if err != nil {
+		return err
+	}
+	return sendTestMessage(subject, strings.Split(body, "\n"))
+}
+
+// webhookNotifier POSTs a JSON payload built by payload to url.
+type webhookNotifier struct {
+	url     string
+	subject *template.Template
+	body    *template.Template
+	payload func(subject, body string) any
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, result BackupResult) error {
+	subject, err := render(n.subject, result)
+	if err != nil {
+		return err
+	}
+	body, err := render(n.body, result)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(n.payload(subject, body))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook %s returned status %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+func genericPayload(subject, body string) any {
+	return map[string]string{"subject": subject, "body": body}
+}
+
+func slackPayload(subject, body string) any {
+	return map[string]string{"text": subject + "\n" + body}
+}
+
+// discordPayload uses Discord's "content" field; Discord silently accepts
+// (and shows nothing for) a "text" field, unlike Slack.
+func discordPayload(subject, body string) any {
+	return map[string]string{"content": subject + "\n" + body}
+}
+
+// slackWebhookURL turns a slack://... or discord://... shorthand into the
+// https:// webhook URL it shadows.
+func slackWebhookURL(url string) string {
+	url = strings.TrimPrefix(url, "slack://")
+	url = strings.TrimPrefix(url, "discord://")
+	return "https://" + url
+}
@@ -0,0 +1,116 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// runBackupItem, runCopyItem, runPruneItem, and runCheckItem each run a
+// single duplicacy invocation for one entry of backupInfo/copyInfo/
+// pruneInfo/checkInfo. They're the unit of work runPhase fans out across
+// maxParallelism() workers, so each must only touch its own info map and
+// the logger it's handed (never the shared performBackup logger directly).
+// Each also captures its own output (in addition to logging it) so the
+// returned OperationResult carries a tail of it for notifications.
+
+func runBackupItem(logger *slog.Logger, info map[string]string) (OperationResult, error) {
+	logger.Debug("######################################################################")
+	name, threads := info["name"], info["threads"]
+	cmdArgs := []string{"backup", "-storage", name, "-threads", threads, "-stats"}
+	opStart := time.Now()
+	logMessage(logger, "backing up", "op", "backup", "storage", name, "threads", threads)
+	if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
+
+	var output []string
+	anon := func(s string) { logger.Debug(s); output = append(output, s) }
+	if err := runDuplicacy(logger, duplicacyPath, cmdArgs, configFile.repoDir, anon); err != nil {
+		logError(logger, "error executing command", "op", "backup", "storage", name, "error", err)
+		return OperationResult{}, err
+	}
+
+	elapsed := time.Since(opStart)
+	logMessage(logger, "backup complete", "op", "backup", "storage", name, "elapsed", elapsed)
+	tail := tailLines(output, operationTailLines)
+	return OperationResult{Op: "backup", Storage: name, Duration: elapsed, Stdout: tail, Stderr: tail}, nil
+}
+
+func runCopyItem(logger *slog.Logger, info map[string]string) (OperationResult, error) {
+	logger.Debug("######################################################################")
+	from, to, threads := info["from"], info["to"], info["threads"]
+	cmdArgs := []string{"copy", "-threads", threads, "-from", from, "-to", to}
+	opStart := time.Now()
+	logMessage(logger, "copying", "op", "copy", "from", from, "to", to, "threads", threads)
+	if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
+
+	var output []string
+	anon := func(s string) { logger.Debug(s); output = append(output, s) }
+	if err := runDuplicacy(logger, duplicacyPath, cmdArgs, configFile.repoDir, anon); err != nil {
+		logError(logger, "error executing command", "op", "copy", "from", from, "to", to, "error", err)
+		return OperationResult{}, err
+	}
+
+	elapsed := time.Since(opStart)
+	logMessage(logger, "copy complete", "op", "copy", "from", from, "to", to, "elapsed", elapsed)
+	tail := tailLines(output, operationTailLines)
+	return OperationResult{Op: "copy", Storage: from + "->" + to, Duration: elapsed, Stdout: tail, Stderr: tail}, nil
+}
+
+func runPruneItem(logger *slog.Logger, info map[string]string) (OperationResult, error) {
+	logger.Debug("######################################################################")
+	storage := info["storage"]
+	cmdArgs := []string{"prune", "-all", "-storage", storage}
+	cmdArgs = append(cmdArgs, strings.Split(info["keep"], " ")...)
+	opStart := time.Now()
+	logMessage(logger, "pruning", "op", "prune", "storage", storage)
+	if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
+
+	var output []string
+	anon := func(s string) { logger.Debug(s); output = append(output, s) }
+	if err := runDuplicacy(logger, duplicacyPath, cmdArgs, configFile.repoDir, anon); err != nil {
+		logError(logger, "error executing command", "op", "prune", "storage", storage, "error", err)
+		return OperationResult{}, err
+	}
+
+	elapsed := time.Since(opStart)
+	logMessage(logger, "prune complete", "op", "prune", "storage", storage, "elapsed", elapsed)
+	tail := tailLines(output, operationTailLines)
+	return OperationResult{Op: "prune", Storage: storage, Duration: elapsed, Stdout: tail, Stderr: tail}, nil
+}
+
+func runCheckItem(logger *slog.Logger, info map[string]string) (OperationResult, error) {
+	logger.Debug("######################################################################")
+	storage := info["storage"]
+	cmdArgs := []string{"check", "-storage", storage}
+	if info["all"] == "true" { cmdArgs = append(cmdArgs, "-all") }
+	opStart := time.Now()
+	logMessage(logger, "checking", "op", "check", "storage", storage)
+	if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
+
+	var output []string
+	anon := func(s string) { logger.Debug(s); output = append(output, s) }
+	if err := runDuplicacy(logger, duplicacyPath, cmdArgs, configFile.repoDir, anon); err != nil {
+		logError(logger, "error executing command", "op", "check", "storage", storage, "error", err)
+		return OperationResult{}, err
+	}
+
+	elapsed := time.Since(opStart)
+	logMessage(logger, "check complete", "op", "check", "storage", storage, "elapsed", elapsed)
+	tail := tailLines(output, operationTailLines)
+	return OperationResult{Op: "check", Storage: storage, Duration: elapsed, Stdout: tail, Stderr: tail}, nil
+}
@@ -0,0 +1,131 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// cmdMaxParallel overrides the global config's maxParallel setting when
+// non-zero (set via -j).
+var cmdMaxParallel int
+
+// maxParallelism returns how many storages within a single phase may run
+// concurrently: the -j flag wins, falling back to the global config's
+// maxParallel, defaulting to 1 (fully sequential, the original behavior).
+func maxParallelism() int {
+	if cmdMaxParallel > 0 {
+		return cmdMaxParallel
+	}
+	if globalMaxParallel > 0 {
+		return globalMaxParallel
+	}
+	return 1
+}
+
+// runPhase runs op once per entry of items. All of the phase's storages run
+// to completion (successfully or not) before runPhase returns, preserving
+// the "all backups finish before any copy starts" ordering performBackup
+// relies on between phases. When maxParallelism() allows more than one
+// worker, entries run concurrently; each worker logs into its own buffered
+// logger and the buffered records are flushed into the shared logger under
+// a mutex once the worker finishes, so one storage's output never
+// interleaves line-by-line with another's. Every item's error is preserved
+// via errors.Join instead of the first one short-circuiting the rest.
+func runPhase(items []map[string]string, logger *slog.Logger, op func(*slog.Logger, map[string]string) (OperationResult, error)) error {
+	limit := maxParallelism()
+
+	if limit <= 1 || len(items) <= 1 {
+		var errs []error
+		for _, item := range items {
+			result, err := op(logger, item)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			recordOperation(result)
+		}
+		return errors.Join(errs...)
+	}
+
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	for _, item := range items {
+		item := item
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			sink := &recordSink{}
+			result, err := op(slog.New(sink), item)
+
+			mu.Lock()
+			defer mu.Unlock()
+			sink.flushTo(logger)
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			recordOperation(result)
+		}()
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// lastOperationsMu guards concurrent appends to the package-level
+// lastOperations slice from runPhase's workers.
+var lastOperationsMu sync.Mutex
+
+func recordOperation(result OperationResult) {
+	lastOperationsMu.Lock()
+	defer lastOperationsMu.Unlock()
+	lastOperations = append(lastOperations, result)
+}
+
+// recordSink is a slog.Handler that just buffers every record it's handed,
+// in order, so a worker goroutine's log output can be replayed into the
+// shared logger contiguously once the worker finishes.
+type recordSink struct {
+	records []slog.Record
+}
+
+func (s *recordSink) Enabled(context.Context, slog.Level) bool { return true }
+
+func (s *recordSink) Handle(_ context.Context, r slog.Record) error {
+	s.records = append(s.records, r.Clone())
+	return nil
+}
+
+func (s *recordSink) WithAttrs(_ []slog.Attr) slog.Handler { return s }
+func (s *recordSink) WithGroup(_ string) slog.Handler      { return s }
+
+// flushTo replays every buffered record into logger's handler, in order.
+func (s *recordSink) flushTo(logger *slog.Logger) {
+	handler := logger.Handler()
+	for _, r := range s.records {
+		handler.Handle(context.Background(), r)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// revisionLineRE matches a line of "duplicacy list" output such as:
+//   Snapshot myrepo revision 12 created at 2020-01-15 03:00 ...
+var revisionLineRE = regexp.MustCompile(`revision (\d+) created at (\d{4}-\d{2}-\d{2} \d{2}:\d{2})`)
+
+// restoredFilesRE matches a line of "duplicacy restore" stats output such as:
+//   Restored 42 files, 3 total chunks
+var restoredFilesRE = regexp.MustCompile(`Restored (\d+) files`)
+
+// performRestore runs a single duplicacy restore operation using the same
+// log file, logger, and notification plumbing as performBackup.
+func performRestore() (err error) {
+	file, err := os.Create(filepath.Join(globalLogDir, cmdConfig + ".restore.log"))
+	if err != nil {
+		logError(nil, fmt.Sprint("Error: ", err))
+		return err
+	}
+	logger := newOperationLogger(file)
+	lastOperations = nil
+	mailBody = nil
+
+	defer func() {
+		if err != nil {
+			if hookErr := runHooks("onFailure", configFile.onFailure, logger); hookErr != nil {
+				logError(logger, fmt.Sprint("Error: onFailure hook failed: ", hookErr))
+			}
+		}
+	}()
+
+	startTime := time.Now()
+	logMessage(logger, fmt.Sprint("Beginning restore on ", time.Now().Format("01-02-2006 15:04:05")))
+
+	storage := cmdRestoreStorage
+	if storage == "" && len(configFile.backupInfo) > 0 {
+		storage = configFile.backupInfo[0]["name"]
+	}
+
+	revision := cmdRestoreRevision
+	if cmdRestoreTime != "" {
+		revision, err = resolveRevisionAtTime(logger, storage, cmdRestoreTime)
+		if err != nil {
+			logError(logger, fmt.Sprint("Error resolving -time to a revision: ", err))
+			return err
+		}
+	}
+	if revision <= 0 {
+		if cmdDryRun && cmdRestoreTime != "" {
+			logMessage(logger, "would resolve -time to a revision (skipped in dry-run, no storage was contacted)", "op", "restore", "storage", storage)
+			return nil
+		}
+		err = fmt.Errorf("no revision to restore: specify -revision or -time")
+		logError(logger, fmt.Sprint("Error: ", err))
+		return err
+	}
+
+	destDir := cmdRestoreDest
+	if destDir == "" {
+		destDir = configFile.repoDir
+	}
+
+	cmdArgs := []string{"restore", "-r", strconv.Itoa(revision), "-storage", storage}
+	if cmdRestorePaths != "" {
+		cmdArgs = append(cmdArgs, strings.Split(cmdRestorePaths, ",")...)
+	}
+
+	logMessage(logger, "restoring", "op", "restore", "storage", storage, "revision", revision, "dest", destDir)
+	if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
+
+	var restoreOutput []string
+	capture := func(s string) {
+		logger.Debug(s)
+		restoreOutput = append(restoreOutput, s)
+	}
+
+	err = runDuplicacy(logger, duplicacyPath, cmdArgs, destDir, capture)
+	if err != nil {
+		logError(logger, "error executing command", "op", "restore", "storage", storage, "error", err)
+		return err
+	}
+
+	summary := summarizeRestoredFiles(restoreOutput)
+	elapsed := time.Since(startTime)
+	logMessage(logger, fmt.Sprintf("restored %s in %s", summary, elapsed), "op", "restore", "storage", storage)
+	tail := tailLines(restoreOutput, operationTailLines)
+	lastOperations = append(lastOperations, OperationResult{Op: "restore", Storage: storage, Duration: elapsed, Stdout: tail, Stderr: tail})
+
+	logMessage(logger, fmt.Sprint("Operations completed in ", elapsed))
+	return nil
+}
+
+// resolveRevisionAtTime shells out to "duplicacy list -storage <name>" and
+// returns the newest revision created at or before target (format
+// "2006-01-02 15:04"), matching the -t UX of duplicity-backup. In dry-run
+// mode this is routed through runDuplicacy like every other duplicacy
+// invocation, so -n never touches remote storage; since there's no real
+// "duplicacy list" output to parse in that case, it returns revision 0 and
+// leaves it to the caller to treat that as "nothing to resolve yet".
+func resolveRevisionAtTime(logger *slog.Logger, storage, target string) (int, error) {
+	targetTime, err := time.Parse("2006-01-02 15:04", target)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -time value %q: %w", target, err)
+	}
+
+	if cmdDryRun {
+		cmdArgs := []string{"list", "-storage", storage}
+		return 0, runDuplicacy(logger, duplicacyPath, cmdArgs, configFile.repoDir, func(string) {})
+	}
+
+	var lines []string
+	capture := func(s string) { lines = append(lines, s) }
+
+	cmdArgs := []string{"list", "-storage", storage}
+	if debugFlag { logMessage(logger, fmt.Sprint("Executing: ", duplicacyPath, cmdArgs)) }
+	if err := runDuplicacy(logger, duplicacyPath, cmdArgs, configFile.repoDir, capture); err != nil {
+		return 0, err
+	}
+
+	best := 0
+	var bestTime time.Time
+	for _, line := range lines {
+		m := revisionLineRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		revision, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		revisionTime, err := time.Parse("2006-01-02 15:04", m[2])
+		if err != nil || revisionTime.After(targetTime) {
+			continue
+		}
+		if best == 0 || revisionTime.After(bestTime) {
+			best, bestTime = revision, revisionTime
+		}
+	}
+
+	if best == 0 {
+		return 0, fmt.Errorf("no revision found at or before %s", target)
+	}
+	return best, nil
+}
+
+// summarizeRestoredFiles extracts a human-readable "restored N files" summary
+// from duplicacy restore's stats output, falling back to a generic message
+// when the count can't be parsed.
+func summarizeRestoredFiles(lines []string) string {
+	for _, line := range lines {
+		if m := restoredFilesRE.FindStringSubmatch(line); m != nil {
+			return m[1] + " files"
+		}
+	}
+	return "files (count unavailable)"
+}